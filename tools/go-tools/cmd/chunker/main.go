@@ -2,49 +2,172 @@ package main
 
 import (
 	"bufio"
+	"container/heap"
 	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
+	"strings"
 )
 
+// deterministicStreamingSample reservoir-samples N float32s out of reader
+// using Vitter's Algorithm L. Unlike plain Algorithm R, which draws one
+// random number per element after the reservoir fills, Algorithm L computes
+// how many elements to skip before the next reservoir replacement and jumps
+// straight there with bufReader.Discard, so a multi-gigabyte stream costs
+// O(N log(len/N)) random draws instead of O(len).
 func deterministicStreamingSample(reader io.Reader, N int, seed int64) ([]float64, error) {
 	r := rand.New(rand.NewSource(seed))
 	result := make([]float64, 0, N)
 	var f float32
-	var count int64 = 0
 
 	bufReader := bufio.NewReader(reader)
 
+	// Fill the reservoir with the first N elements.
+	for len(result) < N {
+		if err := binary.Read(bufReader, binary.LittleEndian, &f); err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return nil, err
+		}
+		result = append(result, float64(f))
+	}
+
+	// w is the probability that stays in the "keep skipping" state; it
+	// shrinks every time we consume an element, which is what makes the
+	// skip distances grow as we move deeper into the stream.
+	w := math.Exp(math.Log(r.Float64()) / float64(N))
+
 	for {
-		err := binary.Read(bufReader, binary.LittleEndian, &f)
-		if err == io.EOF {
-			break
+		skip := int64(math.Floor(math.Log(r.Float64()) / math.Log(1-w)))
+		if skip > 0 {
+			if _, err := bufReader.Discard(4 * int(skip)); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return result, nil
+				}
+				return nil, err
+			}
 		}
-		if err != nil {
+
+		if err := binary.Read(bufReader, binary.LittleEndian, &f); err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
 			return nil, err
 		}
-		count++
-
-		if len(result) < N {
-			result = append(result, float64(f))
-		} else {
-			j := r.Int63n(count)
-			if j < int64(N) {
-				result[j] = float64(f)
+
+		j := r.Intn(N)
+		result[j] = float64(f)
+		w *= math.Exp(math.Log(r.Float64()) / float64(N))
+	}
+}
+
+// aresItem is one candidate in the A-Res weighted reservoir: val is the
+// sampled value and key is u^(1/weight) for a fresh uniform draw u, so that
+// keeping the N largest keys across all candidates yields a sample where
+// each stream contributes in proportion to its weight.
+type aresItem struct {
+	key float64
+	val float64
+}
+
+type aresHeap []aresItem
+
+func (h aresHeap) Len() int            { return len(h) }
+func (h aresHeap) Less(i, j int) bool  { return h[i].key < h[j].key }
+func (h aresHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *aresHeap) Push(x interface{}) { *h = append(*h, x.(aresItem)) }
+func (h *aresHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// mergeStreamSamples combines the per-stream Algorithm L samples into a
+// single stratified sample of size N, using an A-Res weighted reservoir
+// merge so each stream's elements are kept in proportion to weights[i]
+// (its original element count) rather than contributing N elements each
+// regardless of stream length. Each sampled element's own A-Res weight is
+// weights[i] / len(samples[i]), not weights[i] itself: samples[i] already
+// represents weights[i] elements compressed down to len(samples[i])
+// reservoir slots, so every element in it stands in for weights[i]/len
+// original elements, and using the raw stream weight would silently
+// overrepresent any stream shorter than N.
+func mergeStreamSamples(samples [][]float64, weights []float64, N int, r *rand.Rand) []float64 {
+	h := &aresHeap{}
+	heap.Init(h)
+
+	for i, sample := range samples {
+		if len(sample) == 0 {
+			continue
+		}
+		w := weights[i] / float64(len(sample))
+		if w <= 0 {
+			continue
+		}
+		for _, v := range sample {
+			key := math.Pow(r.Float64(), 1/w)
+			if h.Len() < N {
+				heap.Push(h, aresItem{key: key, val: v})
+			} else if key > (*h)[0].key {
+				heap.Pop(h)
+				heap.Push(h, aresItem{key: key, val: v})
 			}
 		}
 	}
 
-	return result, nil
+	result := make([]float64, h.Len())
+	for i, item := range *h {
+		result[i] = item.val
+	}
+	return result
+}
+
+// sampleStream reads N's worth of Algorithm L samples from path and returns
+// them alongside the stream's element count, which doubles as its weight in
+// the stratified merge.
+func sampleStream(path string, N int, seed int64) ([]float64, float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	weight := float64(info.Size() / 4)
+
+	sample, err := deterministicStreamingSample(file, N, seed)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sample, weight, nil
+}
+
+func writeBinary(w io.Writer, data []float64) error {
+	bw := bufio.NewWriter(w)
+	for _, v := range data {
+		if err := binary.Write(bw, binary.LittleEndian, float32(v)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
 }
 
 func main() {
 	N := flag.Int("N", 0, "The number of elements to sample")
 	S := flag.Int("S", 0, "The seed for the random number generator")
+	streams := flag.String("streams", "", "Comma-separated list of binary float32 input files to sample and merge into one stratified sample, instead of reading a single stream from stdin")
+	binaryOut := flag.Bool("binary", false, "Write the sample as little-endian float32 binary to stdout instead of JSON, so it can be piped into another sampler stage")
 	flag.Parse()
 
 	if *N <= 0 {
@@ -52,11 +175,40 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Read and sample binary float32 data from stdin
-	sampledData, err := deterministicStreamingSample(os.Stdin, *N, int64(*S))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error processing input data:", err)
-		os.Exit(1)
+	var sampledData []float64
+
+	if *streams != "" {
+		paths := strings.Split(*streams, ",")
+		samples := make([][]float64, len(paths))
+		weights := make([]float64, len(paths))
+
+		for i, path := range paths {
+			sample, weight, err := sampleStream(path, *N, int64(*S)+int64(i))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error processing stream", path, ":", err)
+				os.Exit(1)
+			}
+			samples[i] = sample
+			weights[i] = weight
+		}
+
+		r := rand.New(rand.NewSource(int64(*S)))
+		sampledData = mergeStreamSamples(samples, weights, *N, r)
+	} else {
+		var err error
+		sampledData, err = deterministicStreamingSample(os.Stdin, *N, int64(*S))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error processing input data:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *binaryOut {
+		if err := writeBinary(os.Stdout, sampledData); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing binary data:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// Write the sampled data as JSON to stdout
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// distBins is the number of histogram bins used to turn a LoadedFile's raw
+// data into an empirical PMF for CmpFilesBhattacharyya, CmpFilesKLDivergence,
+// and CmpFilesJensenShannon. Set from the -bins flag.
+var distBins = 32
+
+// Distribution is an empirical probability mass function over a fixed set
+// of equal-width bins: p sums to 1 (absent any rounding error).
+type Distribution struct {
+	p []float64
+}
+
+// pmfPair bins a and b over their shared range into the same `bins` edges,
+// so the two distributions are directly comparable bin-for-bin, then
+// normalizes each to sum to 1.
+func pmfPair(a, b []float64, bins int) (Distribution, Distribution) {
+	if bins <= 0 {
+		bins = 1
+	}
+
+	min, max := a[0], a[0]
+	for _, v := range a {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	for _, v := range b {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	width := (max - min) / float64(bins)
+	if width == 0 {
+		width = 1
+	}
+
+	bin := func(v float64) int {
+		idx := int((v - min) / width)
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= bins {
+			idx = bins - 1
+		}
+		return idx
+	}
+
+	pa := make([]float64, bins)
+	for _, v := range a {
+		pa[bin(v)]++
+	}
+	pb := make([]float64, bins)
+	for _, v := range b {
+		pb[bin(v)]++
+	}
+
+	na, nb := float64(len(a)), float64(len(b))
+	for i := range pa {
+		pa[i] /= na
+		pb[i] /= nb
+	}
+
+	return Distribution{p: pa}, Distribution{p: pb}
+}
+
+// CmpFilesBhattacharyya computes the Bhattacharyya distance between a and b
+// treated as empirical PMFs (see pmfPair), instead of the previous version
+// which summed sqrt(a[i]*b[i]) over the raw, un-normalized data - meaningless
+// unless a and b already happen to sum to 1.
+func CmpFilesBhattacharyya(a, b *LoadedFile) float64 {
+	pa, pb := pmfPair(a.Data, b.Data, distBins)
+
+	bc := 0.0
+	for i := range pa.p {
+		bc += math.Sqrt(pa.p[i] * pb.p[i])
+	}
+	if bc <= 0 {
+		return math.Inf(1)
+	}
+	return -math.Log(bc)
+}
+
+// CmpFilesKLDivergence computes KL(P || Q) over a and b's shared-binning
+// empirical PMFs, skipping bins where either side has zero support (the
+// divergence is only defined on Q's support, and a zero-probability P bin
+// contributes nothing).
+func CmpFilesKLDivergence(a, b *LoadedFile) float64 {
+	pa, pb := pmfPair(a.Data, b.Data, distBins)
+
+	sum := 0.0
+	for i := range pa.p {
+		if pa.p[i] > 0 && pb.p[i] > 0 {
+			sum += pa.p[i] * math.Log(pa.p[i]/pb.p[i])
+		}
+	}
+	return sum
+}
+
+// CmpFilesJensenShannon computes the (symmetric, always-finite) Jensen-
+// Shannon divergence between a and b's empirical PMFs: the average of
+// KL(P || M) and KL(Q || M) against their mixture M = (P+Q)/2.
+func CmpFilesJensenShannon(a, b *LoadedFile) float64 {
+	pa, pb := pmfPair(a.Data, b.Data, distBins)
+
+	klTo := func(p, m []float64) float64 {
+		sum := 0.0
+		for i := range p {
+			if p[i] > 0 && m[i] > 0 {
+				sum += p[i] * math.Log(p[i]/m[i])
+			}
+		}
+		return sum
+	}
+
+	m := make([]float64, len(pa.p))
+	for i := range m {
+		m[i] = (pa.p[i] + pb.p[i]) / 2
+	}
+
+	return 0.5*klTo(pa.p, m) + 0.5*klTo(pb.p, m)
+}
+
+// pooledCovariance caches the inverse pooled covariance matrix used by
+// CmpFilesMahalanobisPooled, so it's computed once per run (populated by
+// populateCovarianceCache) rather than once per pair of files.
+var (
+	pooledInvCov *mat.SymDense
+	pooledCovMu  sync.Mutex
+)
+
+// populateCovarianceCache builds the d x d covariance matrix (d = sequence
+// length) pooled across every non-missing file, inverts it via a Cholesky
+// solve, and caches the result for CmpFilesMahalanobisPooled. A small ridge
+// is added to the diagonal before factorizing, since the pooled covariance
+// is only positive definite if there are more files than dimensions -
+// otherwise Cholesky factorization fails outright.
+func populateCovarianceCache(files []LoadedFile) {
+	if len(files) == 0 {
+		return
+	}
+
+	// Find the first non-missing file; files[0] itself may be missing.
+	d := -1
+	for _, f := range files {
+		if !f.Missing {
+			d = len(f.Data)
+			break
+		}
+	}
+	if d < 0 {
+		return
+	}
+
+	rows := make([]float64, 0, len(files)*d)
+	n := 0
+	for _, f := range files {
+		if f.Missing {
+			continue
+		}
+		rows = append(rows, f.Data...)
+		n++
+	}
+
+	raw := mat.NewDense(n, d, rows)
+
+	var cov mat.SymDense
+	stat.CovarianceMatrix(&cov, raw, nil)
+
+	trace := 0.0
+	for i := 0; i < d; i++ {
+		trace += cov.At(i, i)
+	}
+	ridge := 1e-6 * (trace / float64(d))
+	for i := 0; i < d; i++ {
+		cov.SetSym(i, i, cov.At(i, i)+ridge)
+	}
+
+	var chol mat.Cholesky
+	if ok := chol.Factorize(&cov); !ok {
+		panic("pooled covariance matrix is not positive definite even after ridge regularization")
+	}
+
+	var inv mat.SymDense
+	if err := chol.InverseTo(&inv); err != nil {
+		panic(err)
+	}
+
+	pooledCovMu.Lock()
+	pooledInvCov = &inv
+	pooledCovMu.Unlock()
+}
+
+// CmpFilesMahalanobisPooled is the real multivariate Mahalanobis distance:
+// sqrt((a-b)^T * Sigma^-1 * (a-b)), where Sigma is the covariance matrix
+// pooled across the whole file set by populateCovarianceCache. Rather than
+// collapsing each file to a scalar mean and dividing by a scalar
+// "covariance", this treats each file's full sequence as one sample from a
+// d-dimensional distribution.
+func CmpFilesMahalanobisPooled(a, b *LoadedFile) float64 {
+	pooledCovMu.Lock()
+	invCov := pooledInvCov
+	pooledCovMu.Unlock()
+	if invCov == nil {
+		panic("pooled covariance cache not populated; call populateCovarianceCache first")
+	}
+
+	d := len(a.Data)
+	diff := mat.NewVecDense(d, nil)
+	for i := range a.Data {
+		diff.SetVec(i, a.Data[i]-b.Data[i])
+	}
+
+	var tmp mat.VecDense
+	tmp.MulVec(invCov, diff)
+
+	return math.Sqrt(mat.Dot(diff, &tmp))
+}
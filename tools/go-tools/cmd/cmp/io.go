@@ -0,0 +1,145 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// openInput opens path for reading and, based on its suffix, transparently
+// wraps it in a gzip or zstd decompressor. Plain .json files are returned
+// unwrapped.
+func openInput(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".json.gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &readCloserChain{Reader: gz, closers: []io.Closer{gz, file}}, nil
+	case strings.HasSuffix(path, ".json.zst"):
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &readCloserChain{Reader: zr, closers: []io.Closer{zstdReadCloser{zr}, file}}, nil
+	default:
+		return file, nil
+	}
+}
+
+// readCloserChain presents a single io.Reader backed by one or more
+// io.Closers that must all be closed, in order, when the chain is closed
+// (e.g. a gzip.Reader followed by the underlying *os.File).
+type readCloserChain struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (c *readCloserChain) Close() error {
+	var firstErr error
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// zstdReadCloser adapts *zstd.Decoder's Close (which returns nothing) to
+// io.Closer so it can sit alongside *os.File in a readCloserChain.
+type zstdReadCloser struct {
+	dec *zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.dec.Close()
+	return nil
+}
+
+// decodeLoadedFiles streams a top-level JSON array of LoadedFile objects
+// from r one element at a time instead of unmarshalling the whole input in
+// one call, so decoding never holds both the raw JSON bytes and the parsed
+// struct at once. It still returns every LoadedFile in one slice - the NxN
+// comparison matrix needs all of them - so overall peak memory is still
+// proportional to the full input, not to a single file.
+func decodeLoadedFiles(r io.Reader) ([]LoadedFile, error) {
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("expected JSON array, got %v", tok)
+	}
+
+	var files []LoadedFile
+	for dec.More() {
+		var lf LoadedFile
+		if err := dec.Decode(&lf); err != nil {
+			return nil, err
+		}
+		files = append(files, lf)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// openOutput creates path for writing and, based on its suffix,
+// transparently wraps it in a gzip or zstd compressor. Plain filenames are
+// returned unwrapped.
+func openOutput(path string) (io.WriteCloser, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz := gzip.NewWriter(file)
+		return &writeCloserChain{Writer: gz, closers: []io.Closer{gz, file}}, nil
+	case strings.HasSuffix(path, ".zst"):
+		zw, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &writeCloserChain{Writer: zw, closers: []io.Closer{zw, file}}, nil
+	default:
+		return file, nil
+	}
+}
+
+// writeCloserChain mirrors readCloserChain for the write side: closing it
+// flushes and closes the compressor before closing the underlying file.
+type writeCloserChain struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (c *writeCloserChain) Close() error {
+	var firstErr error
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bufio"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math"
 	"os"
 	"runtime"
@@ -15,6 +15,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 type Result struct {
@@ -36,6 +38,10 @@ type Output struct {
 	Results []Result `json:"results"`
 }
 
+// lshSentinel marks a (file, file) cell in a -lsh output matrix that was
+// never a LSH candidate and so was never actually compared.
+const lshSentinel = -1.0
+
 func norm(x float64, p float64) float64 {
 	sgn := math.Copysign(1, x)
 	innerFunction := (sgn * math.Log(math.Abs(x)+1)) / -0.3
@@ -92,11 +98,13 @@ func CmpFiles(a, b *LoadedFile, method string) float64 {
 	case "bhattacharyya":
 		return CmpFilesBhattacharyya(a, b)
 	case "mahalanobis":
-		return CmpFilesMahalanobis(a, b)
+		return CmpFilesMahalanobisPooled(a, b)
+	case "jensenShannon":
+		return CmpFilesJensenShannon(a, b)
 	case "spearman":
 		return CmpFilesSpearman(a, b)
 	case "kendall":
-		return CmpFilesKendall(a, b)
+		return CmpFilesKendallTauB(a, b)
 	case "tanimoto":
 		return CmpFilesTanimoto(a, b)
 	case "overlap":
@@ -241,47 +249,47 @@ func CmpFilesKendall(a, b *LoadedFile) float64 {
 	return (concordant - discordant) / (concordant + discordant)
 }
 
-func varCov(dataA, dataB []float64) float64 {
-	meanA := mean(dataA)
-	meanB := mean(dataB)
-	varCov := 0.0
-	for i := range dataA {
-		varCov += (dataA[i] - meanA) * (dataB[i] - meanB)
+// CmpFilesKendallTauB is the tie-corrected Kendall rank correlation. Plain
+// CmpFilesKendall silently lumps every tied pair in with the discordant
+// pairs, which is wrong whenever the data has repeats (as is common once
+// applyNorm has quantized values into buckets). Tau-b instead excludes ties
+// in x and ties in y from their respective halves of the denominator.
+func CmpFilesKendallTauB(a, b *LoadedFile) float64 {
+	n := len(a.Data)
+	concordant, discordant := 0.0, 0.0
+	tiesX, tiesY := 0.0, 0.0
+	for i := 0; i < n-1; i++ {
+		for j := i + 1; j < n; j++ {
+			dx := a.Data[i] - a.Data[j]
+			dy := b.Data[i] - b.Data[j]
+			switch {
+			case dx == 0 && dy == 0:
+				tiesX++
+				tiesY++
+			case dx == 0:
+				tiesX++
+			case dy == 0:
+				tiesY++
+			case dx*dy > 0:
+				concordant++
+			default:
+				discordant++
+			}
+		}
 	}
-	return varCov / float64(len(dataA)-1)
-}
 
-func invertMatrix(matrix float64) float64 {
-	return 1 / matrix
-}
-
-func CmpFilesMahalanobis(a, b *LoadedFile) float64 {
-	meanA := mean(a.Data)
-	meanB := mean(b.Data)
-	diff := meanA - meanB
-	varCovMatrix := varCov(a.Data, b.Data)
-	invVarCovMatrix := invertMatrix(varCovMatrix)
-	mahalanobisDistance := math.Sqrt(diff * invVarCovMatrix * diff)
-	return mahalanobisDistance
-}
-
-func CmpFilesBhattacharyya(a, b *LoadedFile) float64 {
-	sum := 0.0
-	for i := range a.Data {
-		sum += math.Sqrt(a.Data[i] * b.Data[i])
+	n0 := float64(n*(n-1)) / 2
+	denom := math.Sqrt((n0 - tiesX) * (n0 - tiesY))
+	if denom == 0 {
+		return 0
 	}
-	return -math.Log(sum)
+	return (concordant - discordant) / denom
 }
 
-func CmpFilesKLDivergence(a, b *LoadedFile) float64 {
-	sum := 0.0
-	for i := range a.Data {
-		if a.Data[i] != 0 && b.Data[i] != 0 {
-			sum += a.Data[i] * math.Log(a.Data[i]/b.Data[i])
-		}
-	}
-	return sum
-}
+// CmpFilesBhattacharyya, CmpFilesKLDivergence, CmpFilesJensenShannon, and
+// CmpFilesMahalanobisPooled live in distributions.go: they need a shared
+// Distribution/PMF abstraction and, for Mahalanobis, a covariance matrix
+// pooled across the whole file set.
 
 func CmpFilesChiSquare(a, b *LoadedFile) float64 {
 	sum := 0.0
@@ -423,18 +431,30 @@ func mean(data []float64) float64 {
 }
 
 var (
-	rankCache = make(map[string][]float64)
+	rankCache = make(map[uint64][]float64)
 	rankMutex sync.Mutex
 )
 
-func generateKey(data []float64) string {
-	hash := sha256.New()
+// generateKey hashes the raw bits of data with xxhash instead of formatting
+// every value as a decimal string and feeding it through SHA-256 - it's a
+// cache key, not a security boundary, so a cheap, stable 64-bit hash is all
+// that's needed.
+func generateKey(data []float64) uint64 {
+	h := xxhash.New()
+	buf := make([]byte, 8)
 	for _, v := range data {
-		hash.Write([]byte(fmt.Sprintf("%.6f", v)))
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+		h.Write(buf)
 	}
-	return hex.EncodeToString(hash.Sum(nil))
+	return h.Sum64()
 }
 
+// rank computes the fractional (midrank) rank of each element of data: an
+// O(n log n) sort followed by a single pass that assigns every element in a
+// run of equal values the average rank of that run, per the standard
+// Spearman tie-handling convention. The previous O(n^2) implementation also
+// assigned every tied value the same integer rank, which biases
+// CmpFilesSpearman whenever the data has repeats.
 func rank(data []float64) []float64 {
 	key := generateKey(data)
 
@@ -445,15 +465,27 @@ func rank(data []float64) []float64 {
 	}
 	rankMutex.Unlock()
 
+	idx := make([]int, len(data))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return data[idx[i]] < data[idx[j]]
+	})
+
 	ranked := make([]float64, len(data))
-	for i, v := range data {
-		rank := 1
-		for j, w := range data {
-			if i != j && w < v {
-				rank++
-			}
+	for i := 0; i < len(idx); {
+		j := i + 1
+		for j < len(idx) && data[idx[j]] == data[idx[i]] {
+			j++
+		}
+		// Elements idx[i:j] are tied; 1-indexed ranks i+1..j span this run,
+		// so its midrank is their average.
+		midrank := float64(i+1+j) / 2
+		for k := i; k < j; k++ {
+			ranked[idx[k]] = midrank
 		}
-		ranked[i] = float64(rank)
+		i = j
 	}
 
 	rankMutex.Lock()
@@ -492,6 +524,7 @@ func main() {
 			- klDivergence
 			- bhattacharyya
 			- mahalanobis
+			- jensenShannon
 			- spearman
 			- kendall
 			- tanimoto
@@ -510,7 +543,42 @@ func main() {
 	outputFile := flag.String(
 		"output",
 		"",
-		"Path to the output CSV file where the comparison matrix will be saved.",
+		"Path to the output CSV file where the comparison matrix will be saved. A .json suffix writes an Output JSON document with MinHash signatures instead of a comparison matrix.",
+	)
+	lsh := flag.Bool(
+		"lsh",
+		false,
+		"Use MinHash/LSH banding to build a candidate set before comparing, instead of comparing every pair. Scales to large corpora at the cost of missing some true near-duplicates.",
+	)
+	K := flag.Int(
+		"K",
+		128,
+		"Number of MinHash hash functions (signature length). Must be evenly divisible by -B.",
+	)
+	B := flag.Int(
+		"B",
+		16,
+		"Number of LSH bands the MinHash signature is split into. Higher B (more, narrower bands) raises recall; lower B raises precision.",
+	)
+	shingle := flag.Int(
+		"shingle",
+		1,
+		"Shingle length for MinHash tokenization. 1 hashes each (normalized) value independently; >1 hashes windows of consecutive values.",
+	)
+	lshSeed := flag.Int64(
+		"lshSeed",
+		42,
+		"Seed for the MinHash hash function family, so signatures are reproducible across runs.",
+	)
+	format := flag.String(
+		"format",
+		"csv",
+		"Output matrix format: csv (default) or binary, a little-endian float32 lower-triangular matrix with a small header. Independent of -output's .gz/.zst suffix, which controls compression.",
+	)
+	bins := flag.Int(
+		"bins",
+		32,
+		"Number of histogram bins used to turn a file's data into an empirical PMF for -method=bhattacharyya, klDivergence, and jensenShannon.",
 	)
 
 	flag.Usage = func() {
@@ -528,14 +596,41 @@ func main() {
 		fmt.Println("  -method string")
 		fmt.Println("        Comparison method to use. Supported methods include:")
 		fmt.Println(`          jaccard, euclidean, cosine, pearson, manhattan, chebyshev, canberra, braycurtis, minkowski, hamming,
-				chiSquare, klDivergence, bhattacharyya, mahalanobis, spearman, kendall, tanimoto, overlap, hausdorff,
+				chiSquare, klDivergence, bhattacharyya, mahalanobis, jensenShannon, spearman, kendall, tanimoto, overlap, hausdorff,
 				dynamicTimeWarping, editDistance, tversky, all (to execute all methods). (default "all")`)
+		fmt.Println("  -lsh")
+		fmt.Println("        Use MinHash/LSH banding to build a candidate set before comparing, instead of all-pairs. (default false)")
+		fmt.Println("  -K int")
+		fmt.Println("        Number of MinHash hash functions (signature length). Must be evenly divisible by -B. (default 128)")
+		fmt.Println("  -B int")
+		fmt.Println("        Number of LSH bands the MinHash signature is split into. (default 16)")
+		fmt.Println("  -shingle int")
+		fmt.Println("        Shingle length for MinHash tokenization. (default 1)")
+		fmt.Println("  -lshSeed int")
+		fmt.Println("        Seed for the MinHash hash function family. (default 42)")
+		fmt.Println("  -format string")
+		fmt.Println("        Output matrix format: csv or binary. -input/-output ending in .json.gz, .json.zst, .csv.gz, or .csv.zst are transparently compressed. (default \"csv\")")
+		fmt.Println("  -bins int")
+		fmt.Println("        Histogram bins for bhattacharyya, klDivergence, and jensenShannon. (default 32)")
 		fmt.Println("\nExample:")
-		fmt.Printf("  %s -P=0.1 -N=100 -B=10 -method=euclidean -input=data.json -output=results.csv\n", os.Args[0])
+		fmt.Printf("  %s -P=0.1 -N=100 -lsh -K=128 -B=16 -method=euclidean -input=data.json -output=results.csv\n", os.Args[0])
 	}
 
 	flag.Parse()
 
+	distBins = *bins
+
+	if *lsh && *B <= 0 {
+		fmt.Printf("Error: -B (%d) must be a positive integer.\n", *B)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *lsh && *K%*B != 0 {
+		fmt.Printf("Error: -K (%d) must be evenly divisible by -B (%d).\n", *K, *B)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if *inputFile == "" {
 		fmt.Println("Error: -input flag is required.")
 		flag.Usage()
@@ -555,20 +650,23 @@ func main() {
 	fmt.Printf("  Input File: %s\n", *inputFile)
 	fmt.Printf("  Output File: %s\n", *outputFile)
 
-	content, err := ioutil.ReadFile(*inputFile)
+	in, err := openInput(*inputFile)
 	if err != nil {
 		panic(err)
 	}
-
-	var files []LoadedFile
-	err = json.Unmarshal(content, &files)
+	defer in.Close()
+
+	// Decode the LoadedFile array one element at a time instead of reading
+	// the whole input into memory before unmarshalling it. This avoids
+	// double-buffering raw JSON alongside the parsed files during decode;
+	// it does not by itself make the rest of the pipeline sub-linear in
+	// memory, since generateCmpMatrix still needs every file in memory at
+	// once to build the NxN matrix.
+	files, err := decodeLoadedFiles(in)
 	if err != nil {
 		panic(err)
 	}
 
-	// Clear content so it can be GC'd
-	content = nil
-
 	// Reduce the data length to N for each file
 	if *N == 0 {
 		// Find the first non-missing file
@@ -603,6 +701,18 @@ func main() {
 		return files[i].Path < files[j].Path
 	})
 
+	if strings.HasSuffix(*outputFile, ".json") {
+		writeSignatureOutput(files, *outputFile, *P, *K, *B, *shingle, *lshSeed)
+		return
+	}
+
+	// Signatures/candidates don't depend on -method, so with -lsh this is
+	// computed once here rather than once per submethod under -method=all.
+	var candidates map[pairKey]bool
+	if *lsh {
+		candidates = computeLSHCandidates(files, *K, *B, *shingle, *lshSeed)
+	}
+
 	// If method is empty or all, compare all methods
 	if *method == "" || *method == "all" {
 		methods := []string{
@@ -620,6 +730,7 @@ func main() {
 			"klDivergence",
 			"bhattacharyya",
 			"mahalanobis",
+			"jensenShannon",
 			"spearman",
 			"kendall",
 			"tanimoto",
@@ -632,11 +743,44 @@ func main() {
 
 		for _, smethod := range methods {
 			fmt.Printf("Submethod: %s\n", smethod)
-			generateCmpMatrix(files, &smethod, outputFile, P, N)
+			generateCmpMatrix(files, &smethod, outputFile, P, N, *lsh, candidates, *format)
 		}
 	} else {
-		generateCmpMatrix(files, method, outputFile, P, N)
+		generateCmpMatrix(files, method, outputFile, P, N, *lsh, candidates, *format)
+	}
+}
+
+// writeSignatureOutput computes a MinHash signature for every file and
+// writes them as an Output JSON document instead of a comparison matrix.
+// This is the -output=*.json path referenced by -K/-B/-shingle/-lshSeed.
+func writeSignatureOutput(files []LoadedFile, outputFile string, P float64, K, B, shingle int, lshSeed int64) {
+	params := makeHashParams(K, lshSeed)
+
+	out := Output{
+		P:       P,
+		N:       len(files),
+		B:       B,
+		Results: make([]Result, len(files)),
+	}
+
+	for i := range files {
+		var sig []uint64
+		if !files[i].Missing {
+			sig = minHashSignature(files[i].Data, shingle, params)
+		}
+		out.Results[i] = Result{FileName: files[i].Path, MinHash: sig}
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := os.WriteFile(outputFile, data, 0644); err != nil {
+		panic(err)
 	}
+
+	fmt.Printf("Wrote %d MinHash signatures (K=%d) to %s\n", len(out.Results), K, outputFile)
 }
 
 func populateRankCache(files []LoadedFile) {
@@ -671,39 +815,49 @@ func populateRankCache(files []LoadedFile) {
 		}
 	}()
 
-	// Worker function
-	worker := func(start, end int) {
-		for i := start; i < end; i++ {
-			rank(files[i].Data)
-			atomic.AddInt64(&completedRanks, 1)
-		}
+	// Bounded worker pool: numCPU workers pull indices off a channel and
+	// signal completion through wg, rather than busy-polling an atomic
+	// counter until every chunk happens to be done.
+	indices := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indices <- i
 	}
+	close(indices)
 
-	// Start worker goroutines
-	chunkSize := n / numCPU
+	var wg sync.WaitGroup
 	for w := 0; w < numCPU; w++ {
-		start := w * chunkSize
-		end := start + chunkSize
-		if w == numCPU-1 {
-			end = n
-		}
-		go worker(start, end)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				rank(files[i].Data)
+				atomic.AddInt64(&completedRanks, 1)
+			}
+		}()
 	}
 
-	// Wait for all rank computations to complete
-	for atomic.LoadInt64(&completedRanks) < totalRanks {
-		time.Sleep(100 * time.Millisecond)
-	}
+	wg.Wait()
 
 	fmt.Println("\nAll rank computations completed")
 }
 
-func generateCmpMatrix(files []LoadedFile, method *string, outputFile *string, P *float64, N *int) {
+func generateCmpMatrix(files []LoadedFile, method *string, outputFile *string, P *float64, N *int, lsh bool, candidates map[pairKey]bool, format string) {
 	// If method uses ranks, populate the rank cache
 	if *method == "spearman" || *method == "pearson" {
 		populateRankCache(files)
 	}
 
+	// CmpFilesMahalanobisPooled needs the inverse pooled covariance matrix
+	// computed once up front instead of once per pair.
+	if *method == "mahalanobis" {
+		populateCovarianceCache(files)
+	}
+
+	if lsh {
+		generateCmpMatrixLSH(files, method, outputFile, P, N, candidates, format)
+		return
+	}
+
 	// Create a matrix of distances
 	matrix := make([][]float64, len(files))
 	for i := range matrix {
@@ -779,33 +933,275 @@ func generateCmpMatrix(files []LoadedFile, method *string, outputFile *string, P
 
 	fmt.Println("\nAll comparisons completed")
 
-	// Save the matrix as a CSV file
-	outputFileName := fmt.Sprintf("%s_%s_%f_%d.csv", *outputFile, *method, *P, *N)
+	outputFileName := buildOutputPath(*outputFile, *method, *P, *N, format, "")
 	fmt.Printf("Saving results to %s\n", outputFileName)
 
-	file, err := os.Create(outputFileName)
+	file, err := openOutput(outputFileName)
 	if err != nil {
 		panic(err)
 	}
-
 	defer file.Close()
 
+	if format == "binary" {
+		if err := writeBinaryMatrix(file, matrix, *method, *P); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	// Print headers on the first row and column
-	file.WriteString("File")
+	file.Write([]byte("File"))
 	for i := 0; i < len(files); i++ {
-		file.WriteString(",")
-		file.WriteString(files[i].Path)
+		file.Write([]byte(","))
+		file.Write([]byte(files[i].Path))
 	}
 
-	file.WriteString("\n")
+	file.Write([]byte("\n"))
 
 	// Print the matrix
 	for i := 0; i < len(files); i++ {
-		file.WriteString(files[i].Path)
+		file.Write([]byte(files[i].Path))
 		for j := 0; j < len(files); j++ {
-			file.WriteString(fmt.Sprintf(",%f", matrix[i][j]))
+			file.Write([]byte(fmt.Sprintf(",%f", matrix[i][j])))
+		}
+		file.Write([]byte("\n"))
+	}
+}
+
+// buildOutputPath derives the final matrix filename from the user-supplied
+// -output value by appending method/P/N (so running -method=all doesn't
+// clobber one file per method). A trailing .gz/.zst compression suffix and
+// then a trailing .csv (or .bin for -format=binary) extension are stripped
+// from -output first and put back after the appended parts.
+func buildOutputPath(outputFile, method string, P float64, N int, format, tag string) string {
+	compSuffix := ""
+	switch {
+	case strings.HasSuffix(outputFile, ".gz"):
+		compSuffix = ".gz"
+		outputFile = strings.TrimSuffix(outputFile, ".gz")
+	case strings.HasSuffix(outputFile, ".zst"):
+		compSuffix = ".zst"
+		outputFile = strings.TrimSuffix(outputFile, ".zst")
+	}
+
+	ext := "csv"
+	if format == "binary" {
+		ext = "bin"
+	}
+	outputFile = strings.TrimSuffix(outputFile, "."+ext)
+
+	return fmt.Sprintf("%s_%s_%f_%d%s.%s%s", outputFile, method, P, N, tag, ext, compSuffix)
+}
+
+// binaryMatrixMagic identifies a -format=binary matrix file: 4 bytes so a
+// reader can sanity-check before trusting the header that follows.
+const binaryMatrixMagic = "CMPB"
+
+// writeBinaryMatrix writes matrix as a little-endian float32 lower
+// triangular matrix (including the diagonal) preceded by a small header:
+// magic, N, the comparison method name, and P. At N=20000 this is roughly
+// 800 MB versus ~8 GB for the equivalent dense CSV, and the fixed-width
+// layout is trivially memory-mappable by downstream analysis.
+func writeBinaryMatrix(w io.Writer, matrix [][]float64, method string, P float64) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.WriteString(binaryMatrixMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, int64(len(matrix))); err != nil {
+		return err
+	}
+
+	methodBytes := []byte(method)
+	if err := binary.Write(bw, binary.LittleEndian, int32(len(methodBytes))); err != nil {
+		return err
+	}
+	if _, err := bw.Write(methodBytes); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, P); err != nil {
+		return err
+	}
+
+	for i := range matrix {
+		for j := 0; j <= i; j++ {
+			if err := binary.Write(bw, binary.LittleEndian, float32(matrix[i][j])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// binaryCOOMagic identifies a -format=binary -lsh output file: a sparse
+// row,col,value triple list rather than writeBinaryMatrix's dense
+// lower-triangular layout, since most cells were never a LSH candidate.
+const binaryCOOMagic = "CMPS"
+
+// writeBinaryCOO is the -format=binary counterpart to the CSV COO writer in
+// generateCmpMatrixLSH: magic, N, method name, P, triple count (N plus the
+// number of candidate pairs), then one
+// (int64 row, int64 col, float32 value) triple per diagonal entry and per
+// candidate pair. Cells never compared are simply absent, exactly as in the
+// CSV path.
+func writeBinaryCOO(w io.Writer, n int, matrix [][]float64, candidates map[pairKey]bool, method string, P float64) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.WriteString(binaryCOOMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, int64(n)); err != nil {
+		return err
+	}
+
+	methodBytes := []byte(method)
+	if err := binary.Write(bw, binary.LittleEndian, int32(len(methodBytes))); err != nil {
+		return err
+	}
+	if _, err := bw.Write(methodBytes); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, P); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, int64(n+len(candidates))); err != nil {
+		return err
+	}
+
+	writeTriple := func(i, j int, v float64) error {
+		if err := binary.Write(bw, binary.LittleEndian, int64(i)); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.LittleEndian, int64(j)); err != nil {
+			return err
+		}
+		return binary.Write(bw, binary.LittleEndian, float32(v))
+	}
+
+	for i := 0; i < n; i++ {
+		if err := writeTriple(i, i, matrix[i][i]); err != nil {
+			return err
+		}
+	}
+	for pk := range candidates {
+		if err := writeTriple(pk.i, pk.j, matrix[pk.i][pk.j]); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// computeLSHCandidates builds every file's MinHash signature and buckets
+// them with LSH banding into a candidate set. Signatures and candidates
+// depend only on the data and -K/-B/-shingle/-lshSeed, never on -method, so
+// callers should compute this once per run and reuse it across submethods
+// (e.g. -lsh -method=all) rather than recomputing it per method.
+func computeLSHCandidates(files []LoadedFile, K, B, shingle int, lshSeed int64) map[pairKey]bool {
+	n := len(files)
+	params := makeHashParams(K, lshSeed)
+
+	fmt.Printf("Computing %d MinHash signatures (K=%d, shingle=%d)\n", n, K, shingle)
+	signatures := make([][]uint64, n)
+	for i := range files {
+		if files[i].Missing {
+			signatures[i] = make([]uint64, K)
+			continue
+		}
+		signatures[i] = minHashSignature(files[i].Data, shingle, params)
+	}
+
+	candidates := lshCandidates(signatures, B)
+	fmt.Printf("LSH produced %d candidate pairs out of %d possible (B=%d bands)\n", len(candidates), n*(n-1)/2, B)
+	return candidates
+}
+
+// generateCmpMatrixLSH is the -lsh counterpart to generateCmpMatrix: instead
+// of computing every pair, it only calls CmpFiles on the candidate pairs
+// from computeLSHCandidates. Cells that were never a candidate are left as
+// lshSentinel in memory rather than being computed, which is what keeps this
+// sub-quadratic, and are omitted from the sparse output.
+func generateCmpMatrixLSH(files []LoadedFile, method *string, outputFile *string, P *float64, N *int, candidates map[pairKey]bool, format string) {
+	n := len(files)
+
+	matrix := make([][]float64, n)
+	for i := range matrix {
+		matrix[i] = make([]float64, n)
+		for j := range matrix[i] {
+			matrix[i][j] = lshSentinel
+		}
+		// Self-comparison isn't 0 for every method (e.g. jaccard, cosine,
+		// pearson return 1), so compute it the same way the non-LSH path
+		// does rather than assuming 0.
+		if files[i].Missing {
+			matrix[i][i] = math.NaN()
+		} else {
+			matrix[i][i] = CmpFiles(&files[i], &files[i], *method)
+		}
+	}
+
+	var wg sync.WaitGroup
+	pairs := make([]pairKey, 0, len(candidates))
+	for pk := range candidates {
+		pairs = append(pairs, pk)
+	}
+
+	numCPU := runtime.NumCPU()
+	chunkSize := (len(pairs) + numCPU - 1) / numCPU
+	if chunkSize == 0 {
+		chunkSize = 1
+	}
+	for start := 0; start < len(pairs); start += chunkSize {
+		end := start + chunkSize
+		if end > len(pairs) {
+			end = len(pairs)
+		}
+		wg.Add(1)
+		go func(chunk []pairKey) {
+			defer wg.Done()
+			for _, pk := range chunk {
+				fi, fj := &files[pk.i], &files[pk.j]
+				var result float64
+				if fi.Missing || fj.Missing {
+					result = math.NaN()
+				} else {
+					result = CmpFiles(fi, fj, *method)
+				}
+				matrix[pk.i][pk.j] = result
+				matrix[pk.j][pk.i] = result
+			}
+		}(pairs[start:end])
+	}
+	wg.Wait()
+
+	fmt.Println("All candidate comparisons completed")
+
+	outputFileName := buildOutputPath(*outputFile, *method, *P, *N, format, "_lsh")
+	fmt.Printf("Saving sparse LSH results to %s\n", outputFileName)
+
+	file, err := openOutput(outputFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	if format == "binary" {
+		if err := writeBinaryCOO(file, n, matrix, candidates, *method, *P); err != nil {
+			panic(err)
 		}
-		file.WriteString("\n")
+		return
+	}
+
+	// COO header: row,col,value triples for the diagonal plus every
+	// candidate pair. Cells never compared are simply absent; a reader
+	// should treat any (i, j) not listed here as lshSentinel.
+	file.Write([]byte("row,col,value\n"))
+	for i := 0; i < n; i++ {
+		file.Write([]byte(fmt.Sprintf("%d,%d,%f\n", i, i, matrix[i][i])))
+	}
+	for pk := range candidates {
+		file.Write([]byte(fmt.Sprintf("%d,%d,%f\n", pk.i, pk.j, matrix[pk.i][pk.j])))
 	}
 }
 
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand"
+)
+
+// minHashPrime is a prime just above 2^32, used as the modulus for the
+// universal hash family h_i(x) = (a_i*x + b_i) mod prime. Tokens are full
+// 64-bit values and are reduced mod minHashPrime by mulModPrime.
+const minHashPrime = 4294967311 // smallest prime > 2^32
+
+// hashParams holds one (a, b) pair for a single MinHash hash function.
+type hashParams struct {
+	a, b uint64
+}
+
+// makeHashParams deterministically derives K (a, b) pairs from seed so that
+// signatures are reproducible across runs given the same -lshSeed.
+func makeHashParams(K int, seed int64) []hashParams {
+	r := rand.New(rand.NewSource(seed))
+	params := make([]hashParams, K)
+	for i := range params {
+		params[i] = hashParams{
+			a: 1 + uint64(r.Int63())%(minHashPrime-1),
+			b: uint64(r.Int63()) % minHashPrime,
+		}
+	}
+	return params
+}
+
+// tokenize turns a file's (already normalized, if -P is set) data into a set
+// of uint64 tokens suitable for MinHash. shingle == 1 treats each quantized
+// value as its own token; shingle > 1 hashes windows of consecutive values
+// together so near-duplicate runs, not just individual values, collide.
+func tokenize(data []float64, shingle int) []uint64 {
+	if shingle <= 1 {
+		tokens := make([]uint64, len(data))
+		for i, v := range data {
+			tokens[i] = math.Float64bits(v)
+		}
+		return tokens
+	}
+
+	if len(data) < shingle {
+		shingle = len(data)
+	}
+	if shingle == 0 {
+		return nil
+	}
+
+	tokens := make([]uint64, 0, len(data)-shingle+1)
+	buf := make([]byte, 8*shingle)
+	for i := 0; i+shingle <= len(data); i++ {
+		for j := 0; j < shingle; j++ {
+			binary.LittleEndian.PutUint64(buf[j*8:], math.Float64bits(data[i+j]))
+		}
+		h := fnv.New64a()
+		h.Write(buf)
+		tokens = append(tokens, h.Sum64())
+	}
+	return tokens
+}
+
+// mulModPrime computes (a*b) mod minHashPrime without the overflow a plain
+// `a*b % minHashPrime` would hit: tokens routinely exceed minHashPrime
+// (~2^32), so their product with a can exceed 2^64 and wrap before the
+// modulus is ever applied, silently replacing h_i(x) = (a_i*x+b_i) mod prime
+// with an uncontrolled, non-uniform function. This uses binary ("Russian
+// peasant") multiplication, reducing mod minHashPrime after every doubling,
+// so no intermediate value ever exceeds 2*minHashPrime.
+func mulModPrime(a, b uint64) uint64 {
+	a %= minHashPrime
+	b %= minHashPrime
+	var result uint64
+	for b > 0 {
+		if b&1 == 1 {
+			result = (result + a) % minHashPrime
+		}
+		a = (a * 2) % minHashPrime
+		b >>= 1
+	}
+	return result
+}
+
+// minHashSignature computes a length-K MinHash sketch of data: for each of
+// the K hash functions in params, the signature entry is the minimum of
+// h_i(token) over every token derived from data.
+func minHashSignature(data []float64, shingle int, params []hashParams) []uint64 {
+	tokens := tokenize(data, shingle)
+	sig := make([]uint64, len(params))
+	for i, p := range params {
+		min := uint64(math.MaxUint64)
+		for _, t := range tokens {
+			h := (mulModPrime(p.a, t) + p.b) % minHashPrime
+			if h < min {
+				min = h
+			}
+		}
+		sig[i] = min
+	}
+	return sig
+}
+
+// bandBucket hashes one band (R consecutive signature rows) of a signature
+// down to a single bucket id. Two files land in the same bucket for a band
+// only if every row in that band matches exactly.
+func bandBucket(sig []uint64, bandStart, bandSize int) uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	for i := bandStart; i < bandStart+bandSize; i++ {
+		binary.LittleEndian.PutUint64(buf, sig[i])
+		h.Write(buf)
+	}
+	return h.Sum64()
+}
+
+// pairKey canonicalizes a candidate pair so (i, j) and (j, i) collapse to
+// the same map key.
+type pairKey struct{ i, j int }
+
+// lshCandidates buckets every file's MinHash signature into B bands of
+// R = K/B rows each and returns the union, across all bands, of every pair
+// of files that shared a bucket in at least one band. This is the standard
+// LSH "OR of ANDs" construction: a pair is a candidate if it agrees on all R
+// rows of any one band.
+func lshCandidates(signatures [][]uint64, B int) map[pairKey]bool {
+	candidates := make(map[pairKey]bool)
+	if B <= 0 || len(signatures) == 0 {
+		return candidates
+	}
+
+	K := len(signatures[0])
+	R := K / B
+	if R == 0 {
+		return candidates
+	}
+
+	for band := 0; band < B; band++ {
+		bandStart := band * R
+		buckets := make(map[uint64][]int)
+		for fileIdx, sig := range signatures {
+			b := bandBucket(sig, bandStart, R)
+			buckets[b] = append(buckets[b], fileIdx)
+		}
+		for _, members := range buckets {
+			if len(members) < 2 {
+				continue
+			}
+			for a := 0; a < len(members); a++ {
+				for b := a + 1; b < len(members); b++ {
+					i, j := members[a], members[b]
+					if i > j {
+						i, j = j, i
+					}
+					candidates[pairKey{i, j}] = true
+				}
+			}
+		}
+	}
+
+	return candidates
+}